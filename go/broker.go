@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Broker fans room messages out across hub instances. A WebSocketHub
+// publishes every room message to its Broker instead of iterating local
+// clients directly, and consumes its own Subscribe channel to reach them;
+// this is what lets the in-process implementation and the Redis-backed one
+// share one dispatch path.
+type Broker interface {
+	Publish(room string, msg []byte) error
+	// Subscribe returns a channel of messages published to room and an
+	// unsubscribe func that must be called once the caller is done reading.
+	Subscribe(room string) (msgs <-chan []byte, unsubscribe func())
+}
+
+// localBroker is the default Broker: an in-process fan-out with no external
+// dependency, matching the hub's original single-instance behavior.
+type localBroker struct {
+	mu   sync.Mutex
+	subs map[string]map[chan []byte]bool
+}
+
+func newLocalBroker() *localBroker {
+	return &localBroker{subs: make(map[string]map[chan []byte]bool)}
+}
+
+func (b *localBroker) Publish(room string, msg []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs[room] {
+		select {
+		case ch <- msg:
+		default:
+			// Slow subscriber; drop rather than block the publisher.
+		}
+	}
+	return nil
+}
+
+func (b *localBroker) Subscribe(room string) (<-chan []byte, func()) {
+	ch := make(chan []byte, 64)
+
+	b.mu.Lock()
+	if b.subs[room] == nil {
+		b.subs[room] = make(map[chan []byte]bool)
+	}
+	b.subs[room][ch] = true
+	b.mu.Unlock()
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		delete(b.subs[room], ch)
+		if len(b.subs[room]) == 0 {
+			delete(b.subs, room)
+		}
+		b.mu.Unlock()
+		close(ch)
+	}
+	return ch, unsubscribe
+}
+
+// redisBroker shares the broadcast fabric across hub instances behind a load
+// balancer via Redis pub/sub, keyed by a channel-name prefix so the same
+// Redis instance can serve multiple deployments.
+type redisBroker struct {
+	client *redis.Client
+	prefix string
+}
+
+// newRedisBroker connects to the Redis server at addr. channelPrefix is
+// prepended to room names when forming Redis pub/sub channel names.
+func newRedisBroker(addr, channelPrefix string) *redisBroker {
+	return &redisBroker{
+		client: redis.NewClient(&redis.Options{Addr: addr}),
+		prefix: channelPrefix,
+	}
+}
+
+func (b *redisBroker) channel(room string) string {
+	return b.prefix + room
+}
+
+func (b *redisBroker) Publish(room string, msg []byte) error {
+	return b.client.Publish(context.Background(), b.channel(room), msg).Err()
+}
+
+func (b *redisBroker) Subscribe(room string) (<-chan []byte, func()) {
+	pubsub := b.client.Subscribe(context.Background(), b.channel(room))
+	redisMsgs := pubsub.Channel()
+
+	msgs := make(chan []byte, 64)
+	done := make(chan struct{})
+	go func() {
+		defer close(msgs)
+		for {
+			select {
+			case m, ok := <-redisMsgs:
+				if !ok {
+					return
+				}
+				select {
+				case msgs <- []byte(m.Payload):
+				default:
+					// Slow subscriber; drop rather than block the relay.
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	unsubscribe := func() {
+		close(done)
+		if err := pubsub.Close(); err != nil {
+			fmt.Println("redis pubsub close error:", err)
+		}
+	}
+	return msgs, unsubscribe
+}
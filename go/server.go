@@ -1,82 +1,790 @@
 package main
 
 import (
+	"compress/flate"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true }, // Allow any origin
+// HubConfig holds the tunable knobs for a WebSocketHub so operators can
+// adjust them without recompiling: message size limits, keepalive timing,
+// send-buffer depth, compression, and the origin allow-list.
+type HubConfig struct {
+	MaxMessageSize   int64
+	WriteWait        time.Duration
+	PongWait         time.Duration
+	PingPeriod       time.Duration
+	SendBufferSize   int
+	ReadBufferSize   int
+	WriteBufferSize  int
+	CompressionLevel int
+	AllowedOrigins   []string
+}
+
+// DefaultHubConfig returns the settings used where neither a config file nor
+// a flag overrides them. AllowedOrigins is left empty, so checkOrigin falls
+// back to a same-host check.
+func DefaultHubConfig() HubConfig {
+	return HubConfig{
+		MaxMessageSize:   8192,
+		WriteWait:        10 * time.Second,
+		PongWait:         60 * time.Second,
+		PingPeriod:       (60 * time.Second * 9) / 10,
+		SendBufferSize:   256,
+		ReadBufferSize:   4096,
+		WriteBufferSize:  4096,
+		CompressionLevel: flate.BestSpeed,
+	}
+}
+
+// fileConfig mirrors HubConfig for JSON config files, using the subset of
+// fields operators are expected to tune from a file rather than a flag.
+type fileConfig struct {
+	AllowedOrigins   []string `json:"allowed_origins"`
+	MaxMessageSize   int64    `json:"max_message_size"`
+	SendBufferSize   int      `json:"send_buffer_size"`
+	CompressionLevel *int     `json:"compression_level"`
+}
+
+// loadHubConfig builds a HubConfig from defaults, overlaying a JSON config
+// file (if configPath is non-empty) and then a comma-separated
+// -allowed-origins flag, which takes precedence over the file.
+func loadHubConfig(configPath, originsFlag string) (HubConfig, error) {
+	cfg := DefaultHubConfig()
+
+	if configPath != "" {
+		data, err := os.ReadFile(configPath)
+		if err != nil {
+			return cfg, fmt.Errorf("reading config file: %w", err)
+		}
+		var fc fileConfig
+		if err := json.Unmarshal(data, &fc); err != nil {
+			return cfg, fmt.Errorf("parsing config file: %w", err)
+		}
+		if len(fc.AllowedOrigins) > 0 {
+			cfg.AllowedOrigins = fc.AllowedOrigins
+		}
+		if fc.MaxMessageSize > 0 {
+			cfg.MaxMessageSize = fc.MaxMessageSize
+		}
+		if fc.SendBufferSize > 0 {
+			cfg.SendBufferSize = fc.SendBufferSize
+		}
+		if fc.CompressionLevel != nil {
+			// flate.NoCompression is 0, a valid level, so a zero-value int
+			// couldn't distinguish "file set it to 0" from "file omitted
+			// it"; the field is a pointer so nil means the latter.
+			cfg.CompressionLevel = *fc.CompressionLevel
+		}
+	}
+
+	if originsFlag != "" {
+		cfg.AllowedOrigins = strings.Split(originsFlag, ",")
+		for i := range cfg.AllowedOrigins {
+			cfg.AllowedOrigins[i] = strings.TrimSpace(cfg.AllowedOrigins[i])
+		}
+	}
+
+	return cfg, nil
+}
+
+// newUpgrader builds a websocket.Upgrader tuned from cfg, with CheckOrigin
+// validating against cfg.AllowedOrigins instead of allowing any origin.
+func newUpgrader(cfg HubConfig) websocket.Upgrader {
+	return websocket.Upgrader{
+		ReadBufferSize:    cfg.ReadBufferSize,
+		WriteBufferSize:   cfg.WriteBufferSize,
+		EnableCompression: true,
+		CheckOrigin:       checkOrigin(cfg.AllowedOrigins),
+	}
+}
+
+// checkOrigin returns a CheckOrigin func that allows only origins in
+// allowed. With no allow-list configured, it falls back to requiring the
+// Origin header match the request's own Host, which is safe by default
+// rather than permissive.
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		if len(allowed) == 0 {
+			return origin == "http://"+r.Host || origin == "https://"+r.Host
+		}
+		for _, o := range allowed {
+			if o == origin {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Envelope is the JSON message format exchanged over the wire. Type selects
+// which registered handler processes Payload; Room fans a server-originated
+// envelope out to every subscriber of that room, and Recipient, if set,
+// routes it to a single client by ID instead.
+type Envelope struct {
+	Type      string          `json:"type"`
+	Room      string          `json:"room,omitempty"`
+	Sender    string          `json:"sender,omitempty"`
+	Recipient string          `json:"recipient,omitempty"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+// HandlerFunc processes the payload of an inbound envelope of a given type
+// from client. It's registered with WebSocketHub.HandleType.
+type HandlerFunc func(client *Client, payload json.RawMessage) error
+
+const presenceRoom = "presence"
+
+// Client is a single websocket connection registered with the hub. Reads and
+// writes to the underlying connection are confined to readPump and writePump
+// respectively, so conn is never touched concurrently from other goroutines.
+type Client struct {
+	id          string
+	hub         *WebSocketHub
+	conn        *websocket.Conn
+	send        chan []byte
+	closeSignal chan struct{}
+}
+
+// subscription is sent on the hub's subscribe/unsubscribe channels to record
+// or remove a client's room membership from inside run()'s select loop.
+type subscription struct {
+	client *Client
+	room   string
+}
+
+// lookupRequest is sent on the hub's lookup channel to resolve a ClientID to
+// its connected *Client from inside run()'s select loop.
+type lookupRequest struct {
+	id    string
+	reply chan *Client
+}
+
+// registerRequest is sent on the hub's register channel to admit client from
+// inside run()'s select loop. accepted reports whether the client's id was
+// free; handleConnection must close the connection without starting its
+// pumps when it receives false, since run() never added it to any map.
+type registerRequest struct {
+	client   *Client
+	accepted chan bool
+}
+
+// roomMessage carries a payload the broker delivered for room, to be fanned
+// out to that room's locally-connected subscribers by run().
+type roomMessage struct {
+	room    string
+	payload []byte
 }
 
 type WebSocketHub struct {
-	clients   map[*websocket.Conn]bool
-	broadcast chan []byte
-	mutex     sync.Mutex
+	config   HubConfig
+	upgrader websocket.Upgrader
+	broker   Broker
+
+	clients      map[*Client]bool
+	clientsByID  map[string]*Client
+	rooms        map[string]map[*Client]bool
+	brokerCancel map[string]func()
+	handlers     map[string]HandlerFunc
+
+	broadcast   chan Envelope
+	register    chan registerRequest
+	unregister  chan *Client
+	subscribe   chan subscription
+	unsubscribe chan subscription
+	lookup      chan lookupRequest
+	roomCounts  chan chan map[string]int
+	delivery    chan roomMessage
+	shutdown    chan chan struct{}
+	quit        chan struct{}
+
+	shuttingDown int32 // set via atomic; read by handleConnection to reject new upgrades
+	conns        sync.WaitGroup
 }
 
-func newHub() *WebSocketHub {
-	return &WebSocketHub{
-		clients:   make(map[*websocket.Conn]bool),
-		broadcast: make(chan []byte),
+func newHub(cfg HubConfig, broker Broker) *WebSocketHub {
+	h := &WebSocketHub{
+		config:   cfg,
+		upgrader: newUpgrader(cfg),
+		broker:   broker,
+
+		clients:      make(map[*Client]bool),
+		clientsByID:  make(map[string]*Client),
+		rooms:        make(map[string]map[*Client]bool),
+		brokerCancel: make(map[string]func()),
+		handlers:     make(map[string]HandlerFunc),
+
+		broadcast:   make(chan Envelope),
+		register:    make(chan registerRequest),
+		unregister:  make(chan *Client),
+		subscribe:   make(chan subscription),
+		unsubscribe: make(chan subscription),
+		lookup:      make(chan lookupRequest),
+		roomCounts:  make(chan chan map[string]int),
+		delivery:    make(chan roomMessage),
+		shutdown:    make(chan chan struct{}),
+		quit:        make(chan struct{}),
 	}
+	h.registerBuiltinHandlers()
+	return h
 }
 
+// HandleType registers fn as the handler for inbound envelopes whose Type
+// equals name, replacing any handler previously registered for it. Call
+// before run() starts serving connections; handlers themselves may be
+// invoked concurrently from many clients' readPump goroutines, so fn must be
+// safe for concurrent use.
+func (h *WebSocketHub) HandleType(name string, fn HandlerFunc) {
+	h.handlers[name] = fn
+}
+
+// registerBuiltinHandlers wires up the message types the transport itself
+// depends on: ping/pong keepalive at the application layer and room
+// subscription management.
+func (h *WebSocketHub) registerBuiltinHandlers() {
+	h.HandleType("ping", func(client *Client, _ json.RawMessage) error {
+		h.broadcast <- Envelope{Type: "pong", Recipient: client.id}
+		return nil
+	})
+
+	h.HandleType("subscribe", func(client *Client, payload json.RawMessage) error {
+		var body struct {
+			Room string `json:"room"`
+		}
+		if err := json.Unmarshal(payload, &body); err != nil {
+			return fmt.Errorf("subscribe: %w", err)
+		}
+		h.Subscribe(client, body.Room)
+		return nil
+	})
+
+	h.HandleType("unsubscribe", func(client *Client, payload json.RawMessage) error {
+		var body struct {
+			Room string `json:"room"`
+		}
+		if err := json.Unmarshal(payload, &body); err != nil {
+			return fmt.Errorf("unsubscribe: %w", err)
+		}
+		h.Unsubscribe(client, body.Room)
+		return nil
+	})
+}
+
+// joinRoom records client as a member of room, starting a broker
+// subscription for room if this is its first local member.
+func (h *WebSocketHub) joinRoom(client *Client, room string) {
+	members, ok := h.rooms[room]
+	if !ok {
+		members = make(map[*Client]bool)
+		h.rooms[room] = members
+		h.startBrokerSubscription(room)
+	}
+	members[client] = true
+}
+
+// leaveRoom removes client from room, stopping room's broker subscription
+// once it has no local members left.
+func (h *WebSocketHub) leaveRoom(client *Client, room string) {
+	members, ok := h.rooms[room]
+	if !ok {
+		return
+	}
+	delete(members, client)
+	if len(members) == 0 {
+		delete(h.rooms, room)
+		if cancel, ok := h.brokerCancel[room]; ok {
+			cancel()
+			delete(h.brokerCancel, room)
+		}
+	}
+}
+
+// startBrokerSubscription subscribes to room on the broker and relays every
+// message it publishes into h.delivery for run() to fan out locally.
+func (h *WebSocketHub) startBrokerSubscription(room string) {
+	msgs, unsubscribe := h.broker.Subscribe(room)
+	h.brokerCancel[room] = unsubscribe
+
+	go func() {
+		for payload := range msgs {
+			h.delivery <- roomMessage{room: room, payload: payload}
+		}
+	}()
+}
+
+// run owns all mutations of the hub's client, room and broker-subscription
+// maps, so no lock is needed: registration, subscription, and dispatch all
+// happen inside this single select loop. The handler registry is the
+// exception; HandleType writes it before run() starts.
 func (h *WebSocketHub) run() {
 	for {
-		message := <-h.broadcast
-		h.mutex.Lock()
-		for client := range h.clients {
-			err := client.WriteMessage(websocket.TextMessage, message)
-			if err != nil {
-				client.Close()
+		select {
+		case req := <-h.register:
+			if _, taken := h.clientsByID[req.client.id]; taken {
+				// The HasClient check in handleConnection is only a
+				// fast-path rejection: two connections racing the same
+				// ?user_id= can both pass it before either registers. This
+				// is the authoritative check, made from inside the single
+				// goroutine that owns clientsByID, so reject here rather
+				// than overwrite and strand the first connection.
+				req.accepted <- false
+				continue
+			}
+			h.clients[req.client] = true
+			h.clientsByID[req.client.id] = req.client
+			req.accepted <- true
+			h.broadcastPresence("user_joined", req.client.id)
+
+		case client := <-h.unregister:
+			if _, ok := h.clients[client]; ok {
 				delete(h.clients, client)
+				// Only remove the id->client mapping if it still points at
+				// this client: a colliding ?user_id= that raced past the
+				// HasClient check in handleConnection must not evict the
+				// still-connected client that holds the id now.
+				if h.clientsByID[client.id] == client {
+					delete(h.clientsByID, client.id)
+				}
+				for room := range h.rooms {
+					h.leaveRoom(client, room)
+				}
+				close(client.send)
+				h.broadcastPresence("user_left", client.id)
 			}
+
+		case sub := <-h.subscribe:
+			h.joinRoom(sub.client, sub.room)
+
+		case unsub := <-h.unsubscribe:
+			h.leaveRoom(unsub.client, unsub.room)
+
+		case env := <-h.broadcast:
+			h.dispatch(env)
+
+		case msg := <-h.delivery:
+			h.deliverLocal(msg.room, msg.payload)
+
+		case req := <-h.lookup:
+			req.reply <- h.clientsByID[req.id]
+
+		case reply := <-h.roomCounts:
+			counts := make(map[string]int, len(h.rooms))
+			for room, members := range h.rooms {
+				counts[room] = len(members)
+			}
+			reply <- counts
+
+		case reply := <-h.shutdown:
+			for client := range h.clients {
+				close(client.closeSignal)
+			}
+			close(reply)
+
+		case <-h.quit:
+			for room, cancel := range h.brokerCancel {
+				cancel()
+				delete(h.brokerCancel, room)
+			}
+			close(h.broadcast)
+			return
 		}
-		h.mutex.Unlock()
 	}
 }
 
-func (h *WebSocketHub) handleConnection(w http.ResponseWriter, r *http.Request) {
+// dispatch routes an envelope either to a single recipient (when set), which
+// is always a local lookup, or to its room's broker, which relays it back to
+// every instance's deliverLocal via that room's broker subscription -
+// including this one. Called only from run()'s select loop.
+func (h *WebSocketHub) dispatch(env Envelope) {
+	payload, err := json.Marshal(env)
+	if err != nil {
+		log.Println("envelope marshal error:", err)
+		return
+	}
+
+	if env.Recipient != "" {
+		if client, ok := h.clientsByID[env.Recipient]; ok {
+			h.send(client, payload)
+		}
+		return
+	}
+
+	h.publishAsync(env.Room, payload)
+}
+
+// publishAsync hands payload to the broker off of run()'s goroutine. For
+// redisBroker, Publish is a synchronous network round trip; calling it
+// inline here would block every register/unregister/subscribe/delivery/
+// lookup until Redis acks, reintroducing the head-of-line blocking the
+// per-client send queues were built to eliminate. The broker itself is safe
+// for concurrent use, so publishes may run concurrently with run() and with
+// each other.
+func (h *WebSocketHub) publishAsync(room string, payload []byte) {
+	go func() {
+		if err := h.broker.Publish(room, payload); err != nil {
+			log.Println("broker publish error:", err)
+		}
+	}()
+}
 
-	fmt.Println("WebSocket connection established")
-	conn, err := upgrader.Upgrade(w, r, nil)
+// broadcastPresence publishes a user_joined/user_left event to presenceRoom.
+func (h *WebSocketHub) broadcastPresence(eventType, clientID string) {
+	payload, err := json.Marshal(Envelope{Type: eventType, Sender: clientID, Room: presenceRoom})
 	if err != nil {
-		log.Println("WebSocket Upgrade Error:", err)
+		log.Println("presence envelope marshal error:", err)
 		return
 	}
+	h.publishAsync(presenceRoom, payload)
+}
 
-	h.mutex.Lock()
-	h.clients[conn] = true
-	h.mutex.Unlock()
+// deliverLocal fans a broker-relayed payload out to room's locally-connected
+// subscribers. Called only from run()'s select loop.
+func (h *WebSocketHub) deliverLocal(room string, payload []byte) {
+	for client := range h.rooms[room] {
+		h.send(client, payload)
+	}
+}
 
+// send enqueues payload on client's send channel, dropping the client if its
+// queue is full rather than blocking the hub. Called only from run()'s
+// select loop.
+func (h *WebSocketHub) send(client *Client, payload []byte) {
+	select {
+	case client.send <- payload:
+	default:
+		delete(h.clients, client)
+		if h.clientsByID[client.id] == client {
+			delete(h.clientsByID, client.id)
+		}
+		for room := range h.rooms {
+			h.leaveRoom(client, room)
+		}
+		close(client.send)
+	}
+}
+
+// Subscribe adds client to room, taking effect on the next run() iteration.
+func (h *WebSocketHub) Subscribe(client *Client, room string) {
+	h.subscribe <- subscription{client: client, room: room}
+}
+
+// Unsubscribe removes client from room, taking effect on the next run()
+// iteration.
+func (h *WebSocketHub) Unsubscribe(client *Client, room string) {
+	h.unsubscribe <- subscription{client: client, room: room}
+}
+
+// RoomMembership returns the number of subscribers in each non-empty room.
+// It's a synchronous query into run(), since run() owns h.rooms and it must
+// not be read from other goroutines directly.
+func (h *WebSocketHub) RoomMembership() map[string]int {
+	reply := make(chan map[string]int, 1)
+	h.roomCounts <- reply
+	return <-reply
+}
+
+// Shutdown stops the hub from accepting new connections, signals every
+// connected client's writePump to send a CloseGoingAway close frame, and
+// waits for all connections' read and write pumps to finish draining
+// (bounded by ctx). Once drained - or ctx expires first - it cancels every
+// outstanding broker subscription, closes the broadcast channel, and
+// terminates run(), so no hub goroutine is left running once Shutdown
+// returns.
+func (h *WebSocketHub) Shutdown(ctx context.Context) error {
+	atomic.StoreInt32(&h.shuttingDown, 1)
+
+	reply := make(chan struct{})
+	h.shutdown <- reply
+	<-reply
+
+	drained := make(chan struct{})
+	go func() {
+		h.conns.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	h.quit <- struct{}{}
+	return err
+}
+
+// readPump pumps messages from the websocket connection to the hub.
+//
+// The application runs readPump in a per-connection goroutine. It ensures
+// there is at most one reader on a connection by executing all reads here.
+func (c *Client) readPump() {
 	defer func() {
-		h.mutex.Lock()
-		delete(h.clients, conn)
-		h.mutex.Unlock()
-		conn.Close()
+		c.hub.unregister <- c
+		c.conn.Close()
+		// Done last: once this fires, readPump will never touch another hub
+		// channel, which is what Shutdown relies on before it closes them.
+		c.hub.conns.Done()
 	}()
 
+	cfg := c.hub.config
+	c.conn.SetReadLimit(cfg.MaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(cfg.PongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(cfg.PongWait))
+		return nil
+	})
+
 	for {
-		_, msg, err := conn.ReadMessage()
+		_, msg, err := c.conn.ReadMessage()
 		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Println("WebSocket read error:", err)
+			}
 			break
 		}
-		h.broadcast <- msg
+
+		var env Envelope
+		if err := json.Unmarshal(msg, &env); err != nil {
+			log.Println("invalid envelope:", err)
+			continue
+		}
+
+		handler, ok := c.hub.handlers[env.Type]
+		if !ok {
+			log.Println("no handler registered for message type:", env.Type)
+			continue
+		}
+		if err := handler(c, env.Payload); err != nil {
+			log.Println("handler error for type", env.Type, ":", err)
+		}
 	}
 }
 
+// writePump pumps messages from the hub to the websocket connection.
+//
+// A goroutine running writePump is started for each connection. It ensures
+// there is at most one writer on a connection by executing all writes here.
+func (c *Client) writePump() {
+	cfg := c.hub.config
+	ticker := time.NewTicker(cfg.PingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+		c.hub.conns.Done()
+	}()
+
+	for {
+		select {
+		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(cfg.WriteWait))
+			if !ok {
+				// The hub closed the channel.
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(cfg.WriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+
+		case <-c.closeSignal:
+			c.conn.SetWriteDeadline(time.Now().Add(cfg.WriteWait))
+			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+			return
+		}
+	}
+}
+
+// HasClient reports whether a client with the given ID is currently
+// connected.
+func (h *WebSocketHub) HasClient(id string) bool {
+	_, ok := h.GetClient(id)
+	return ok
+}
+
+// GetClient returns the connected client with the given ID, if any.
+func (h *WebSocketHub) GetClient(id string) (*Client, bool) {
+	reply := make(chan *Client, 1)
+	h.lookup <- lookupRequest{id: id, reply: reply}
+	client := <-reply
+	return client, client != nil
+}
+
+func (h *WebSocketHub) handleConnection(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&h.shuttingDown) == 1 {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	id := r.URL.Query().Get("user_id")
+	if id == "" {
+		id = newClientID()
+	} else if h.HasClient(id) {
+		// A ?user_id= must be unique among live connections: directed
+		// delivery and HasClient/GetClient identify a client by this ID
+		// alone, so a second connection reusing it (e.g. two tabs) would
+		// make one of them unreachable. Reject rather than silently
+		// clobbering the first connection's entry.
+		http.Error(w, "user_id already connected", http.StatusConflict)
+		return
+	}
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("WebSocket Upgrade Error:", err)
+		return
+	}
+
+	conn.EnableWriteCompression(true)
+	// h.config.CompressionLevel always holds a resolved value (default or
+	// file override) by this point, including flate.NoCompression, so it's
+	// set unconditionally.
+	if err := conn.SetCompressionLevel(h.config.CompressionLevel); err != nil {
+		log.Println("SetCompressionLevel error:", err)
+	}
+
+	fmt.Println("WebSocket connection established:", id)
+
+	client := &Client{
+		id:          id,
+		hub:         h,
+		conn:        conn,
+		send:        make(chan []byte, h.config.SendBufferSize),
+		closeSignal: make(chan struct{}),
+	}
+	// One count each for writePump and readPump, added before either the
+	// register send or the goroutines themselves: conns.Done() can otherwise
+	// run before conns.Add() does, which is invalid WaitGroup use and lets
+	// Shutdown's conns.Wait() return while pumps are still live.
+	h.conns.Add(2)
+
+	accepted := make(chan bool, 1)
+	client.hub.register <- registerRequest{client: client, accepted: accepted}
+	if !<-accepted {
+		// run() found id already taken; it never added this client to any
+		// map, so there are no pumps to wait for.
+		h.conns.Add(-2)
+		conn.Close()
+		return
+	}
+
+	go client.writePump()
+	go client.readPump()
+}
+
+// handleRooms reports current room membership counts for observability.
+func (h *WebSocketHub) handleRooms(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.RoomMembership()); err != nil {
+		log.Println("rooms encode error:", err)
+	}
+}
+
+// newClientID generates a random 16-byte hex identifier for connections that
+// don't supply their own ?user_id=.
+func newClientID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("client-%p", buf)
+	}
+	return fmt.Sprintf("%x", buf)
+}
+
 func main() {
-	hub := newHub()
+	addr := flag.String("addr", ":8080", "address to listen on")
+	configFile := flag.String("config", "", "path to a JSON config file (allowed_origins, max_message_size, send_buffer_size, compression_level)")
+	allowedOrigins := flag.String("allowed-origins", "", "comma-separated list of origins allowed to open a WebSocket connection")
+	redisAddr := flag.String("redis-addr", "", "Redis address for cross-instance broadcast (in-process broker is used when empty)")
+	flag.Parse()
+
+	cfg, err := loadHubConfig(*configFile, *allowedOrigins)
+	if err != nil {
+		log.Fatal("loading config:", err)
+	}
+
+	var broker Broker
+	if *redisAddr != "" {
+		broker = newRedisBroker(*redisAddr, "real-time-webapp:")
+	} else {
+		broker = newLocalBroker()
+	}
+
+	hub := newHub(cfg, broker)
+
+	// "chat" is an example of an application-registered message type: it
+	// re-broadcasts the payload to the room named in it, on top of the
+	// ping/subscribe/unsubscribe/presence handlers the hub wires up itself.
+	hub.HandleType("chat", func(client *Client, payload json.RawMessage) error {
+		var body struct {
+			Room string `json:"room"`
+		}
+		if err := json.Unmarshal(payload, &body); err != nil {
+			return fmt.Errorf("chat: %w", err)
+		}
+		hub.broadcast <- Envelope{Type: "chat", Room: body.Room, Sender: client.id, Payload: payload}
+		return nil
+	})
+
 	go hub.run()
 
-	http.HandleFunc("/ws", hub.handleConnection)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", hub.handleConnection)
+	mux.HandleFunc("/rooms", hub.handleRooms)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	srv := &http.Server{
+		Addr:    *addr,
+		Handler: mux,
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+
+	go func() {
+		fmt.Println("WebSocket server listening on", *addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("ListenAndServe:", err)
+		}
+	}()
+
+	<-ctx.Done()
+	fmt.Println("shutting down...")
 
-	port := "8080"
-	fmt.Println("WebSocket server listening on port", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("HTTP server shutdown error:", err)
+	}
+	if err := hub.Shutdown(shutdownCtx); err != nil {
+		log.Println("hub shutdown error:", err)
+	}
 }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestHub starts a hub backed by an in-process broker and an httptest
+// server exposing it at /ws, and returns both. The server is closed through
+// t.Cleanup.
+func newTestHub(t *testing.T) (*WebSocketHub, *httptest.Server) {
+	t.Helper()
+
+	hub := newHub(DefaultHubConfig(), newLocalBroker())
+
+	// "chat" is registered by main() in production, not by the hub itself
+	// (see server.go); tests that exercise chat fan-out need to wire up the
+	// same application-level handler.
+	hub.HandleType("chat", func(client *Client, payload json.RawMessage) error {
+		var body struct {
+			Room string `json:"room"`
+		}
+		if err := json.Unmarshal(payload, &body); err != nil {
+			return fmt.Errorf("chat: %w", err)
+		}
+		hub.broadcast <- Envelope{Type: "chat", Room: body.Room, Sender: client.id, Payload: payload}
+		return nil
+	})
+
+	go hub.run()
+
+	srv := httptest.NewServer(http.HandlerFunc(hub.handleConnection))
+	t.Cleanup(srv.Close)
+
+	return hub, srv
+}
+
+// dialClient opens a websocket connection to srv as userID and waits for the
+// hub to finish registering it.
+func dialClient(t *testing.T, hub *WebSocketHub, srv *httptest.Server, userID string) *websocket.Conn {
+	t.Helper()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?user_id=" + userID
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dial %s: %v", userID, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	waitFor(t, func() bool { return hub.HasClient(userID) })
+	return conn
+}
+
+// waitFor polls cond until it's true or a short timeout elapses.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("condition not met before timeout")
+}
+
+func sendEnvelope(t *testing.T, conn *websocket.Conn, env Envelope) {
+	t.Helper()
+	if err := conn.WriteJSON(env); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+}
+
+// readEnvelope reads one message, failing the test if none arrives within
+// timeout.
+func readEnvelope(t *testing.T, conn *websocket.Conn, timeout time.Duration) Envelope {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	var env Envelope
+	if err := conn.ReadJSON(&env); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+	return env
+}
+
+// expectNoMessage asserts conn receives nothing within timeout.
+func expectNoMessage(t *testing.T, conn *websocket.Conn, timeout time.Duration) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	if _, _, err := conn.ReadMessage(); err == nil {
+		t.Fatal("expected no message, but one arrived")
+	}
+}
+
+func TestRoomTargetedDelivery(t *testing.T) {
+	hub, srv := newTestHub(t)
+
+	alice := dialClient(t, hub, srv, "alice")
+	bob := dialClient(t, hub, srv, "bob")
+	carol := dialClient(t, hub, srv, "carol")
+
+	sendEnvelope(t, alice, Envelope{Type: "subscribe", Payload: json.RawMessage(`{"room":"general"}`)})
+	sendEnvelope(t, bob, Envelope{Type: "subscribe", Payload: json.RawMessage(`{"room":"general"}`)})
+	waitFor(t, func() bool { return hub.RoomMembership()["general"] == 2 })
+
+	sendEnvelope(t, alice, Envelope{Type: "chat", Payload: json.RawMessage(`{"room":"general","text":"hi"}`)})
+
+	// Room fan-out: both subscribers (including the sender) see the chat
+	// message; carol, who never subscribed, sees nothing.
+	for _, c := range []*websocket.Conn{alice, bob} {
+		env := readEnvelope(t, c, time.Second)
+		if env.Type != "chat" || env.Room != "general" || env.Sender != "alice" {
+			t.Fatalf("unexpected envelope: %+v", env)
+		}
+	}
+	expectNoMessage(t, carol, 200*time.Millisecond)
+
+	// Targeted delivery: ping replies only to the sender via Recipient, not
+	// to every room subscriber.
+	sendEnvelope(t, alice, Envelope{Type: "ping"})
+	pong := readEnvelope(t, alice, time.Second)
+	if pong.Type != "pong" {
+		t.Fatalf("expected pong, got %+v", pong)
+	}
+	expectNoMessage(t, bob, 200*time.Millisecond)
+}
+
+func TestShutdownDrainsConnectionsWithoutLeaks(t *testing.T) {
+	hub, srv := newTestHub(t)
+
+	// Baseline before any client connects, so every pump goroutine the two
+	// connections start must be gone again for the final check to pass.
+	runtime.GC()
+	baseline := runtime.NumGoroutine()
+
+	alice := dialClient(t, hub, srv, "alice")
+	bob := dialClient(t, hub, srv, "bob")
+	_ = alice
+	_ = bob
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := hub.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	// Both clients should have received a CloseGoingAway frame.
+	for _, c := range []*websocket.Conn{alice, bob} {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err := c.ReadMessage()
+		closeErr, ok := err.(*websocket.CloseError)
+		if !ok || closeErr.Code != websocket.CloseGoingAway {
+			t.Fatalf("expected CloseGoingAway, got %v", err)
+		}
+	}
+
+	// A connection attempt after Shutdown must be rejected outright.
+	resp, err := http.Get(srv.URL + "/ws?user_id=dave")
+	if err != nil {
+		t.Fatalf("GET after shutdown: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 after shutdown, got %d", resp.StatusCode)
+	}
+
+	waitFor(t, func() bool {
+		runtime.GC()
+		return runtime.NumGoroutine() <= baseline
+	})
+
+	fmt.Println("goroutines before:", baseline, "after:", runtime.NumGoroutine())
+}